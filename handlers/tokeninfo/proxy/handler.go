@@ -2,7 +2,10 @@ package tokeninfoproxy
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -14,46 +17,95 @@ import (
 	"github.com/rcrowley/go-metrics"
 	"github.com/zalando/planb-tokeninfo/handlers/tokeninfo"
 	"github.com/zalando/planb-tokeninfo/options"
+	"github.com/zalando/planb-tokeninfo/revoke"
+	"golang.org/x/sync/singleflight"
+)
+
+// noRetryHeader lets a caller opt a single request out of the retry
+// behaviour below, e.g. for health checks that would rather fail fast.
+const noRetryHeader = "X-No-Retry"
+
+// Defaults for the upstream retry policy; options.AppSettings can override
+// each of them.
+const (
+	defaultUpstreamRetryMaxAttempts = 3
+	defaultUpstreamRetryBackoffMin  = 250 * time.Millisecond
+	defaultUpstreamRetryBackoffMax  = 4 * time.Second
 )
 
 type tokenInfoProxyHandler struct {
 	upstream *httputil.ReverseProxy
 	cache    *ccache.Cache
 	cacheTTL time.Duration
+	staleTTL time.Duration
+	sf       singleflight.Group
+}
+
+// cacheEntry is what gets stored in the ccache.Cache. cachedAt lets
+// ServeHTTP tell whether the entry was issued before a later FORCEREFRESH
+// revocation, in which case it must be treated as a miss even though it
+// hasn't expired. softExpiresAt is the soft (cacheTTL) deadline; the
+// ccache item itself expires at the hard (cacheTTL+staleTTL) deadline, so
+// between the two the entry is stale-but-usable.
+type cacheEntry struct {
+	body          []byte
+	cachedAt      int64
+	softExpiresAt int64
 }
 
 // NewTokenInfoProxyHandler returns an tokeninfo.Handler that proxies every Request to the server
 // at the upstreamURL when the env var UPSTREAM_UUID_TOKENS is set to false. When set to a true
-// value the upstreamURL will just get tokens which look like a UUID
-func NewTokenInfoProxyHandler(upstreamURL *url.URL, cacheMaxSize int64, cacheTTL time.Duration) tokeninfo.Handler {
-	log.Printf("Upstream tokeninfo is %s with %v cache (%d max size)", upstreamURL, cacheTTL, cacheMaxSize)
+// value the upstreamURL will just get tokens which look like a UUID. Cached responses are served
+// as-is for cacheTTL; between cacheTTL and cacheTTL+staleTTL they're served stale while a single
+// background request per token refreshes them.
+func NewTokenInfoProxyHandler(upstreamURL *url.URL, cacheMaxSize int64, cacheTTL, staleTTL time.Duration) tokeninfo.Handler {
+	log.Printf("Upstream tokeninfo is %s with %v cache (stale for %v, %d max size)", upstreamURL, cacheTTL, staleTTL, cacheMaxSize)
 	p := httputil.NewSingleHostReverseProxy(upstreamURL)
 	p.Director = hostModifier(upstreamURL, p.Director)
 	cache := ccache.New(ccache.Configure().MaxSize(cacheMaxSize))
-	return &tokenInfoProxyHandler{upstream: p, cache: cache, cacheTTL: cacheTTL}
+	return &tokenInfoProxyHandler{upstream: p, cache: cache, cacheTTL: cacheTTL, staleTTL: staleTTL}
 }
 
-func newResponseBuffer(w http.ResponseWriter) *responseBuffer {
+// responseBuffer captures a single upstream attempt fully in memory instead
+// of streaming it straight to the client. That's what makes the response
+// retryable: nothing reaches the real http.ResponseWriter until ServeHTTP
+// has decided the attempt is the one it's keeping.
+func newResponseBuffer() *responseBuffer {
 	return &responseBuffer{
-		ResponseWriter: w,
-		Buffer:         &bytes.Buffer{},
+		header: make(http.Header),
+		Buffer: &bytes.Buffer{},
 	}
 }
 
 type responseBuffer struct {
-	http.ResponseWriter
+	header     http.Header
 	Buffer     *bytes.Buffer
 	StatusCode int
 }
 
+func (rw *responseBuffer) Header() http.Header {
+	return rw.header
+}
+
 func (rw *responseBuffer) WriteHeader(status int) {
 	rw.StatusCode = status
-	rw.ResponseWriter.WriteHeader(status)
 }
 
 func (rw *responseBuffer) Write(b []byte) (int, error) {
-	rw.Buffer.Write(b)
-	return rw.ResponseWriter.Write(b)
+	if rw.StatusCode == 0 {
+		rw.StatusCode = http.StatusOK
+	}
+	return rw.Buffer.Write(b)
+}
+
+// flushTo copies the buffered attempt to the real ResponseWriter.
+func (rw *responseBuffer) flushTo(w http.ResponseWriter) {
+	header := w.Header()
+	for k, vs := range rw.header {
+		header[k] = vs
+	}
+	w.WriteHeader(rw.StatusCode)
+	w.Write(rw.Buffer.Bytes())
 }
 
 func incCounter(key string) {
@@ -62,6 +114,174 @@ func incCounter(key string) {
 	}
 }
 
+// attemptsHistogram is the histogram backing planb.tokeninfo.proxy.upstream.attempts.
+func attemptsHistogram() metrics.Histogram {
+	return metrics.DefaultRegistry.GetOrRegister("planb.tokeninfo.proxy.upstream.attempts", func() metrics.Histogram {
+		return metrics.NewHistogram(metrics.NewUniformSample(1028))
+	}).(metrics.Histogram)
+}
+
+// retrySettings reads the upstream retry knobs from options.AppSettings,
+// falling back to sane defaults when unset.
+func retrySettings() (maxAttempts int, backoffMin, backoffMax time.Duration) {
+	maxAttempts = options.AppSettings.UpstreamRetryMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultUpstreamRetryMaxAttempts
+	}
+	backoffMin = options.AppSettings.UpstreamRetryBackoffMin
+	if backoffMin <= 0 {
+		backoffMin = defaultUpstreamRetryBackoffMin
+	}
+	backoffMax = options.AppSettings.UpstreamRetryBackoffMax
+	if backoffMax <= 0 {
+		backoffMax = defaultUpstreamRetryBackoffMax
+	}
+	return
+}
+
+// commandTimeout returns the hystrix timeout configured for the named
+// command, so retries never get scheduled past the point hystrix itself
+// would already have given up.
+func commandTimeout(name string) time.Duration {
+	if settings, ok := hystrix.GetCircuitSettings()[name]; ok {
+		// settings.Timeout is already a time.Duration (hystrix-go converts
+		// the configured millisecond value itself); multiplying it by
+		// time.Millisecond again would inflate it by another 1e6x.
+		return settings.Timeout
+	}
+	return time.Duration(hystrix.DefaultTimeout) * time.Millisecond
+}
+
+// backoffWithFullJitter picks a truncated exponential backoff for the given
+// 0-indexed attempt, drawn uniformly from [0, min(max, base*2^attempt)], per
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func backoffWithFullJitter(attempt int, base, max time.Duration) time.Duration {
+	exp := base
+	for i := 0; i < attempt; i++ {
+		exp *= 2
+		if exp <= 0 || exp > max { // overflowed or already past the cap
+			exp = max
+			break
+		}
+	}
+	if exp > max { // base itself may already exceed the cap
+		exp = max
+	}
+	return time.Duration(rand.Int63n(int64(exp) + 1))
+}
+
+// isRetryableStatus reports whether an upstream status code is worth a
+// retry: any 5xx except 501, which means the upstream has deliberately told
+// us it doesn't implement the request and trying again won't help.
+func isRetryableStatus(status int) bool {
+	return status >= http.StatusInternalServerError && status != http.StatusNotImplemented
+}
+
+// writeCachedResponse writes a cached entry to w, tagging it with the given X-Cache value
+// (HIT, STALE or STALE-ERROR).
+func writeCachedResponse(w http.ResponseWriter, entry *cacheEntry, cacheStatus string) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Write(entry.body)
+}
+
+// store caches body under token, recording both the soft (cacheTTL) and hard
+// (cacheTTL+staleTTL) expiry.
+func (h *tokenInfoProxyHandler) store(token string, body []byte) {
+	now := time.Now()
+	h.cache.Set(token, &cacheEntry{
+		body:          body,
+		cachedAt:      now.Unix(),
+		softExpiresAt: now.Add(h.cacheTTL).Unix(),
+	}, h.cacheTTL+h.staleTTL)
+}
+
+// liveEntry returns the cached entry for token, provided it hasn't hard-expired and hasn't
+// been invalidated by a FORCEREFRESH revocation. It returns nil otherwise.
+func (h *tokenInfoProxyHandler) liveEntry(token string) *cacheEntry {
+	item := h.cache.Get(token)
+	if item == nil || item.Expired() {
+		return nil
+	}
+	entry := item.Value().(*cacheEntry)
+	if revoke.ForceRefreshedBefore(entry.cachedAt) {
+		return nil
+	}
+	return entry
+}
+
+// revalidateAsync refreshes token's cache entry in the background. Concurrent calls for the
+// same token are collapsed into a single upstream request via h.sf. req is cloned onto
+// context.Background() first: net/http cancels the inbound request's context as soon as
+// ServeHTTP returns, which happens right after this is called, so the original context would
+// make the upstream call fail before it ever had a chance to run.
+func (h *tokenInfoProxyHandler) revalidateAsync(token string, req *http.Request) {
+	detached := req.Clone(context.Background())
+	go func() {
+		h.sf.Do(token, func() (interface{}, error) {
+			rw, err := h.fetchUpstreamWithCircuit(detached)
+			if err == nil && rw.StatusCode == http.StatusOK && h.cacheTTL > 0 {
+				h.store(token, rw.Buffer.Bytes())
+				incCounter("planb.tokeninfo.proxy.cache.revalidations")
+			}
+			return nil, err
+		})
+	}()
+}
+
+// fetchUpstreamWithCircuit calls the upstream through the "proxy" hystrix command, retrying
+// transient failures as described by retrySettings.
+func (h *tokenInfoProxyHandler) fetchUpstreamWithCircuit(req *http.Request) (*responseBuffer, error) {
+	// The body can only be read once, but a retried attempt needs to send it
+	// again, so read it up front and give each attempt its own fresh reader.
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	var rw *responseBuffer
+	err := hystrix.Do("proxy", func() error {
+		upstreamStart := time.Now()
+		deadline := upstreamStart.Add(commandTimeout("proxy"))
+		maxAttempts, backoffMin, backoffMax := retrySettings()
+		if req.Header.Get(noRetryHeader) != "" {
+			maxAttempts = 1
+		}
+
+		attempt := 0
+		for {
+			attempt++
+			if req.Body != nil {
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			rw = newResponseBuffer()
+			rw.Header().Set("X-Cache", "MISS")
+			h.upstream.ServeHTTP(rw, req)
+
+			if !isRetryableStatus(rw.StatusCode) || attempt >= maxAttempts {
+				break
+			}
+			wait := backoffWithFullJitter(attempt-1, backoffMin, backoffMax)
+			if time.Now().Add(wait).After(deadline) {
+				break
+			}
+			incCounter("planb.tokeninfo.proxy.upstream.retries")
+			time.Sleep(wait)
+		}
+		attemptsHistogram().Update(int64(attempt))
+
+		upstreamTimer := metrics.DefaultRegistry.GetOrRegister("planb.tokeninfo.proxy.upstream", metrics.NewTimer).(metrics.Timer)
+		upstreamTimer.UpdateSince(upstreamStart)
+		return nil
+	}, nil)
+	return rw, err
+}
+
 // ServeHTTP proxies the Request with an Access Token to the upstream and sends back the response
 // from the upstream
 func (h *tokenInfoProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -71,33 +291,46 @@ func (h *tokenInfoProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reque
 		return
 	}
 	start := time.Now()
-	item := h.cache.Get(token)
-	if item != nil {
-		if !item.Expired() {
+	if entry := h.liveEntry(token); entry != nil {
+		if time.Now().Unix() < entry.softExpiresAt {
 			incCounter("planb.tokeninfo.proxy.cache.hits")
-			w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-			w.Header().Set("X-Cache", "HIT")
-			w.Write(item.Value().([]byte))
+			writeCachedResponse(w, entry, "HIT")
 			return
-		} else {
+		}
+		incCounter("planb.tokeninfo.proxy.cache.stale_hits")
+		writeCachedResponse(w, entry, "STALE")
+		h.revalidateAsync(token, req)
+		return
+	}
+	// The only way to reach this point with a non-nil item is a FORCEREFRESH
+	// revocation: anything else within the hard TTL was already served above
+	// as a HIT or STALE. Keep that entry as a fallback for the STALE-ERROR
+	// case below instead of deleting it outright - re-fetching it after
+	// h.cache.Delete would just find it gone.
+	var fallback *cacheEntry
+	if item := h.cache.Get(token); item != nil {
+		if item.Expired() {
 			incCounter("planb.tokeninfo.proxy.cache.expirations")
+		} else {
+			incCounter("planb.tokeninfo.proxy.cache.force_refresh")
+			fallback = item.Value().(*cacheEntry)
 		}
+		h.cache.Delete(token)
 	}
+
 	incCounter("planb.tokeninfo.proxy.cache.misses")
-	err := hystrix.Do("proxy", func() error {
-		upstreamStart := time.Now()
-		rw := newResponseBuffer(w)
-		rw.Header().Set("X-Cache", "MISS")
-		h.upstream.ServeHTTP(rw, req)
-		if rw.StatusCode == http.StatusOK && h.cacheTTL > 0 {
-			h.cache.Set(token, rw.Buffer.Bytes(), h.cacheTTL)
-		}
-		upstreamTimer := metrics.DefaultRegistry.GetOrRegister("planb.tokeninfo.proxy.upstream", metrics.NewTimer).(metrics.Timer)
-		upstreamTimer.UpdateSince(upstreamStart)
-		return nil
-	}, nil)
+	rw, err := h.fetchUpstreamWithCircuit(req)
 
 	if err != nil {
+		switch err {
+		case hystrix.ErrCircuitOpen, hystrix.ErrTimeout, hystrix.ErrMaxConcurrency:
+			if fallback != nil {
+				incCounter("planb.tokeninfo.proxy.cache.stale_error_hits")
+				writeCachedResponse(w, fallback, "STALE-ERROR")
+				return
+			}
+		}
+
 		status := http.StatusInternalServerError
 		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 		switch err {
@@ -122,6 +355,11 @@ func (h *tokenInfoProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	if rw.StatusCode == http.StatusOK && h.cacheTTL > 0 {
+		h.store(token, rw.Buffer.Bytes())
+	}
+	rw.flushTo(w)
+
 	t := metrics.DefaultRegistry.GetOrRegister("planb.tokeninfo.proxy", metrics.NewTimer).(metrics.Timer)
 	t.UpdateSince(start)
 }
@@ -0,0 +1,285 @@
+package tokeninfoproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/zalando/planb-tokeninfo/options"
+	"github.com/zalando/planb-tokeninfo/revoke"
+)
+
+func newTestHandler(t *testing.T, upstream *httptest.Server, cacheTTL, staleTTL time.Duration) *tokenInfoProxyHandler {
+	t.Helper()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", upstream.URL, err)
+	}
+	return NewTokenInfoProxyHandler(u, 1000, cacheTTL, staleTTL).(*tokenInfoProxyHandler)
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/tokeninfo", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// withRetrySettings temporarily overrides the retry knobs so tests don't pay
+// the real default backoff, and restores them afterwards.
+func withRetrySettings(t *testing.T, maxAttempts int, backoffMin, backoffMax time.Duration) {
+	t.Helper()
+	prevMax, prevMin, prevCap := options.AppSettings.UpstreamRetryMaxAttempts, options.AppSettings.UpstreamRetryBackoffMin, options.AppSettings.UpstreamRetryBackoffMax
+	options.AppSettings.UpstreamRetryMaxAttempts = maxAttempts
+	options.AppSettings.UpstreamRetryBackoffMin = backoffMin
+	options.AppSettings.UpstreamRetryBackoffMax = backoffMax
+	t.Cleanup(func() {
+		options.AppSettings.UpstreamRetryMaxAttempts = prevMax
+		options.AppSettings.UpstreamRetryBackoffMin = prevMin
+		options.AppSettings.UpstreamRetryBackoffMax = prevCap
+	})
+}
+
+func TestServeHTTPCacheMissFetchesAndCaches(t *testing.T) {
+	withRetrySettings(t, 1, time.Millisecond, time.Millisecond)
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"uid":"foo"}`))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	req := bearerRequest("tok-miss")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS", got)
+	}
+	if got := w.Body.String(); got != `{"uid":"foo"}` {
+		t.Errorf("body = %q", got)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("upstream hits = %d, want 1", hits)
+	}
+
+	// Second request for the same token should now be served from cache.
+	w2 := httptest.NewRecorder()
+	h.ServeHTTP(w2, bearerRequest("tok-miss"))
+	if got := w2.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("X-Cache = %q, want HIT", got)
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("upstream hits after cache hit = %d, want still 1", hits)
+	}
+}
+
+func TestServeHTTPForceRefreshedEntryIsTreatedAsMiss(t *testing.T) {
+	withRetrySettings(t, 1, time.Millisecond, time.Millisecond)
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"uid":"fresh"}`))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	token := "tok-force-refresh"
+
+	h.ServeHTTP(httptest.NewRecorder(), bearerRequest(token))
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("expected one upstream hit to prime the cache, got %d", hits)
+	}
+
+	// Force a revocation whose IssuedBefore is after the entry's cachedAt.
+	threshold := time.Now().Add(time.Second).Unix()
+	revoke.UpdateForceRefreshThreshold(threshold)
+	// The watermark only ever increases, so it can't be reset; wait until it's
+	// in the past instead, so entries cached by later tests aren't treated as
+	// force-refreshed.
+	defer func() {
+		for time.Now().Unix() < threshold {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(token))
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS for a force-refreshed entry", got)
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("upstream hits = %d, want 2 (force-refresh must not serve the stale cached copy)", hits)
+	}
+}
+
+func TestFetchUpstreamWithCircuitRetriesRetryableStatus(t *testing.T) {
+	withRetrySettings(t, 3, time.Millisecond, 5*time.Millisecond)
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"uid":"recovered"}`))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	rw, err := h.fetchUpstreamWithCircuit(bearerRequest("tok-retry"))
+	if err != nil {
+		t.Fatalf("fetchUpstreamWithCircuit: %v", err)
+	}
+	if rw.StatusCode != http.StatusOK {
+		t.Errorf("StatusCode = %d, want 200 after retries recover", rw.StatusCode)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestFetchUpstreamWithCircuitDoesNotRetry501(t *testing.T) {
+	withRetrySettings(t, 3, time.Millisecond, 5*time.Millisecond)
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	rw, err := h.fetchUpstreamWithCircuit(bearerRequest("tok-501"))
+	if err != nil {
+		t.Fatalf("fetchUpstreamWithCircuit: %v", err)
+	}
+	if rw.StatusCode != http.StatusNotImplemented {
+		t.Errorf("StatusCode = %d, want 501", rw.StatusCode)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("attempts = %d, want 1 (501 must not be retried)", got)
+	}
+}
+
+func TestFetchUpstreamWithCircuitNoRetryHeaderSkipsRetries(t *testing.T) {
+	withRetrySettings(t, 3, time.Millisecond, 5*time.Millisecond)
+	var attempts int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	req := bearerRequest("tok-no-retry")
+	req.Header.Set(noRetryHeader, "1")
+
+	rw, err := h.fetchUpstreamWithCircuit(req)
+	if err != nil {
+		t.Fatalf("fetchUpstreamWithCircuit: %v", err)
+	}
+	if rw.StatusCode != http.StatusBadGateway {
+		t.Errorf("StatusCode = %d, want 502", rw.StatusCode)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("attempts = %d, want 1 (X-No-Retry must skip retries)", got)
+	}
+}
+
+func TestServeHTTPStaleServesImmediatelyAndRevalidatesInBackground(t *testing.T) {
+	withRetrySettings(t, 1, time.Millisecond, time.Millisecond)
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"hit":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	// Soft TTL expires almost immediately; hard TTL stays open for a while so
+	// the entry is servable as stale.
+	h := newTestHandler(t, upstream, 10*time.Millisecond, time.Minute)
+	token := "tok-stale"
+
+	h.ServeHTTP(httptest.NewRecorder(), bearerRequest(token))
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("expected one upstream hit to prime the cache, got %d", hits)
+	}
+
+	time.Sleep(20 * time.Millisecond) // cross the soft TTL, stay under the hard one
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(token))
+	if got := w.Header().Get("X-Cache"); got != "STALE" {
+		t.Fatalf("X-Cache = %q, want STALE", got)
+	}
+	if got := w.Body.String(); got != `{"hit":1}` {
+		t.Errorf("body = %q, want the stale (pre-revalidation) body", got)
+	}
+
+	// The background revalidation is asynchronous; give it a moment to land,
+	// then confirm the cache was refreshed with a second upstream hit.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Fatalf("upstream hits = %d, want 2 (background revalidation never ran)", got)
+	}
+}
+
+func TestServeHTTPStaleErrorFallback(t *testing.T) {
+	withRetrySettings(t, 1, time.Millisecond, time.Millisecond)
+	hystrix.ConfigureCommand("proxy", hystrix.CommandConfig{
+		Timeout:                20,
+		MaxConcurrentRequests:  10,
+		ErrorPercentThreshold:  100,
+		RequestVolumeThreshold: 100000,
+		SleepWindow:            1,
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond) // force hystrix.ErrTimeout
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, upstream, time.Minute, time.Minute)
+	token := "tok-stale-error"
+
+	// Seed a cache entry that's already been FORCEREFRESHed - the only way
+	// ServeHTTP's miss path can still have a fallback entry around (see
+	// liveEntry/ServeHTTP: anything merely stale-but-live is already served
+	// earlier as HIT/STALE without ever reaching the upstream call).
+	h.store(token, []byte(`{"fallback":true}`))
+	item := h.cache.Get(token)
+	if item == nil {
+		t.Fatal("expected a cache entry right after store()")
+	}
+	entry := item.Value().(*cacheEntry)
+	revoke.UpdateForceRefreshThreshold(entry.cachedAt + 1)
+	defer revoke.UpdateForceRefreshThreshold(0)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, bearerRequest(token))
+
+	if got := w.Header().Get("X-Cache"); got != "STALE-ERROR" {
+		t.Fatalf("X-Cache = %q, want STALE-ERROR (status %d, body %q)", got, w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "fallback") {
+		t.Errorf("body = %q, want the fallback entry's body", w.Body.String())
+	}
+}
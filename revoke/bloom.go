@@ -0,0 +1,84 @@
+package revoke
+
+import (
+	"crypto/sha256"
+	"math"
+)
+
+// bloomFilter is a fixed-size Bloom filter. Membership tests for k
+// independent hash functions are simulated via double hashing (Kirsch &
+// Mitzenmacher): h_i = h1 + i*h2, derived from a single SHA-256 digest split
+// into two 64-bit halves.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// newBloomFilter sizes a filter for n expected items at false-positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = defaultBloomFalsePositiveRate
+	}
+	m := optimalBits(n, p)
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    optimalHashes(m, n),
+	}
+}
+
+// optimalBits is the classic m = ceil(-n*ln(p) / ln(2)^2).
+func optimalBits(n int, p float64) uint64 {
+	m := math.Ceil(-1 * float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m < 1 {
+		m = 1
+	}
+	return uint64(m)
+}
+
+// optimalHashes is the classic k = round((m/n) * ln(2)).
+func optimalHashes(m uint64, n int) uint64 {
+	k := math.Round(float64(m) / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return uint64(k)
+}
+
+// hashPair derives two independent 64-bit hashes from s's SHA-256 digest.
+func hashPair(s string) (h1, h2 uint64) {
+	sum := sha256.Sum256([]byte(s))
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[i+8])
+	}
+	if h2 == 0 {
+		h2 = 1 // a zero step would make every h_i collapse onto h1
+	}
+	return h1, h2
+}
+
+func (f *bloomFilter) add(s string) {
+	h1, h2 := hashPair(s)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mightContain reports whether s may have been added. A false result is
+// definitive; a true result may be a false positive.
+func (f *bloomFilter) mightContain(s string) bool {
+	h1, h2 := hashPair(s)
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
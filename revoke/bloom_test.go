@@ -0,0 +1,197 @@
+package revoke
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestBloomFilterAddAndMightContain(t *testing.T) {
+	f := newBloomFilter(1000, 0.01)
+	present := []string{"token-a", "token-b", "token-c"}
+	for _, s := range present {
+		f.add(s)
+	}
+	for _, s := range present {
+		if !f.mightContain(s) {
+			t.Errorf("mightContain(%q) = false, want true (it was added)", s)
+		}
+	}
+	if f.mightContain("never-added") {
+		// Not a hard failure - Bloom filters can false-positive - but at this
+		// size/fpRate with a single unrelated key it would be surprising.
+		t.Logf("mightContain(%q) = true; unexpected false positive with only %d items added", "never-added", len(present))
+	}
+}
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	const n = 5000
+	f := newBloomFilter(n, 0.01)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "hash-" + strconv.Itoa(i)
+		f.add(keys[i])
+	}
+	for _, k := range keys {
+		if !f.mightContain(k) {
+			t.Fatalf("mightContain(%q) = false, want true: Bloom filters must never false-negative", k)
+		}
+	}
+}
+
+func TestBloomFilterFalsePositiveRateRoughlyMatchesTarget(t *testing.T) {
+	const n = 10000
+	const fpRate = 0.01
+	f := newBloomFilter(n, fpRate)
+	for i := 0; i < n; i++ {
+		f.add("present-" + strconv.Itoa(i))
+	}
+
+	falsePositives := 0
+	const trials = 10000
+	for i := 0; i < trials; i++ {
+		if f.mightContain("absent-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	// Generous bound: the measured rate shouldn't run away to many multiples
+	// of the target, which would indicate a sizing bug rather than noise.
+	if got := float64(falsePositives) / trials; got > fpRate*5 {
+		t.Errorf("false positive rate = %v, want roughly %v (<= %v)", got, fpRate, fpRate*5)
+	}
+}
+
+func TestCacheSetAndMightBeRevoked(t *testing.T) {
+	c := NewCache(0.01)
+	c.Set([]*Revocation{
+		{Type: REVOCATION_TYPE_TOKEN, Data: map[string]interface{}{"token_hash": "tok-1"}},
+		{Type: REVOCATION_TYPE_CLAIM, Data: map[string]interface{}{"value_hash": "claim-1"}},
+	})
+
+	if !c.MightBeRevoked("tok-1") {
+		t.Error("MightBeRevoked(tok-1) = false, want true")
+	}
+	if !c.MightBeRevoked("claim-1") {
+		t.Error("MightBeRevoked(claim-1) = false, want true")
+	}
+	if !c.CheckRevoked("tok-1") {
+		t.Error("CheckRevoked(tok-1) = false, want true")
+	}
+
+	// Replacing the set should rebuild the filters so stale entries are gone.
+	c.Set([]*Revocation{
+		{Type: REVOCATION_TYPE_TOKEN, Data: map[string]interface{}{"token_hash": "tok-2"}},
+	})
+	if c.CheckRevoked("tok-1") {
+		t.Error("CheckRevoked(tok-1) = true after Set dropped it, want false")
+	}
+	if !c.CheckRevoked("tok-2") {
+		t.Error("CheckRevoked(tok-2) = false, want true")
+	}
+}
+
+func TestCacheCheckRevokedCountsFalsePositives(t *testing.T) {
+	c := NewCache(0.01)
+	c.Set([]*Revocation{
+		{Type: REVOCATION_TYPE_TOKEN, Data: map[string]interface{}{"token_hash": "tok-1"}},
+	})
+
+	before := falsePositiveCount()
+	// Force a false positive: something the exact map doesn't contain but
+	// that the filter (forced to have every bit set) will claim as a maybe.
+	c.mu.Lock()
+	c.tokenFilter = &bloomFilter{bits: []uint64{^uint64(0)}, m: 64, k: 4}
+	c.mu.Unlock()
+
+	if c.CheckRevoked("definitely-not-revoked") {
+		t.Fatal("CheckRevoked should not report an exact miss as revoked")
+	}
+	if after := falsePositiveCount(); after != before+1 {
+		t.Errorf("false_positives counter = %d, want %d", after, before+1)
+	}
+}
+
+func TestCacheRebuildIsRaceFree(t *testing.T) {
+	c := NewCache(0.01)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Set([]*Revocation{
+					{Type: REVOCATION_TYPE_TOKEN, Data: map[string]interface{}{"token_hash": fmt.Sprintf("tok-%d-%d", i, j)}},
+				})
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.MightBeRevoked("tok-0-0")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// linearScanRevoked is the O(n) check the Bloom filter lets callers skip:
+// walk every revocation and compare hashes directly. It's the baseline
+// BenchmarkLinearScanRevoked measures against BenchmarkMightBeRevoked.
+func linearScanRevoked(revocations []*Revocation, hash string) bool {
+	for _, r := range revocations {
+		if revocationKey(r) == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func benchRevocations(n int) []*Revocation {
+	revocations := make([]*Revocation, n)
+	for i := range revocations {
+		revocations[i] = &Revocation{
+			Type: REVOCATION_TYPE_TOKEN,
+			Data: map[string]interface{}{"token_hash": "revoked-" + strconv.Itoa(i)},
+		}
+	}
+	return revocations
+}
+
+func BenchmarkLinearScanRevoked(b *testing.B) {
+	revocations := benchRevocations(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if linearScanRevoked(revocations, "not-revoked-at-all") {
+			b.Fatal("unexpected hit")
+		}
+	}
+}
+
+func BenchmarkMightBeRevoked(b *testing.B) {
+	c := NewCache(0.01)
+	c.Set(benchRevocations(100000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if c.MightBeRevoked("not-revoked-at-all") {
+			b.Fatal("unexpected maybe")
+		}
+	}
+}
+
+// falsePositiveCount reads the current value of the false-positive counter
+// so tests can assert it was incremented.
+func falsePositiveCount() int64 {
+	c, ok := metrics.DefaultRegistry.GetOrRegister(
+		"planb.tokeninfo.revoke.bloom.false_positives", metrics.NewCounter,
+	).(metrics.Counter)
+	if !ok {
+		return 0
+	}
+	return c.Count()
+}
@@ -0,0 +1,149 @@
+package revoke
+
+import (
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// defaultBloomFalsePositiveRate is the target false-positive rate used to
+// size the Bloom filters when the cache is rebuilt.
+const defaultBloomFalsePositiveRate = 0.01
+
+// Cache holds the current set of revocations received from the Revocation
+// Provider, indexed by the hash callers look them up by, plus a pair of
+// Bloom filters (one for TOKEN hashes, one for CLAIM value hashes) that let
+// the token-validation path skip the exact check entirely for the common
+// case of a token that hasn't been revoked.
+type Cache struct {
+	mu          sync.RWMutex
+	revocations map[string]*Revocation
+	tokenFilter *bloomFilter
+	claimFilter *bloomFilter
+	fpRate      float64
+}
+
+// NewCache returns an empty Cache. fpRate is the target Bloom filter
+// false-positive rate; a value <= 0 falls back to defaultBloomFalsePositiveRate.
+func NewCache(fpRate float64) *Cache {
+	if fpRate <= 0 {
+		fpRate = defaultBloomFalsePositiveRate
+	}
+	c := &Cache{
+		revocations: make(map[string]*Revocation),
+		fpRate:      fpRate,
+	}
+	c.rebuildFilters()
+	return c
+}
+
+// Set replaces the cached revocation set and rebuilds the Bloom filters. It's
+// called whenever a fresh batch is received from the Revocation Provider -
+// the point at which a FORCEREFRESH revocation actually takes effect, so
+// this is also where it advances the package-wide force-refresh watermark.
+func (c *Cache) Set(revocations []*Revocation) {
+	m := make(map[string]*Revocation, len(revocations))
+	for _, r := range revocations {
+		if r.Type == REVOCATION_TYPE_FORCEREFRESH {
+			if issuedBefore, ok := r.Data["issued_before"].(int); ok {
+				UpdateForceRefreshThreshold(int64(issuedBefore))
+			}
+			continue
+		}
+		if key := revocationKey(r); key != "" {
+			m[key] = r
+		}
+	}
+	c.mu.Lock()
+	c.revocations = m
+	c.rebuildFiltersLocked()
+	c.mu.Unlock()
+}
+
+// revocationKey picks the hash a revocation is looked up by: token_hash for
+// TOKEN, value_hash for CLAIM. GLOBAL and FORCEREFRESH revocations aren't
+// addressed by hash and are excluded.
+func revocationKey(r *Revocation) string {
+	if h, ok := r.Data["token_hash"].(string); ok && h != "" {
+		return h
+	}
+	if h, ok := r.Data["value_hash"].(string); ok && h != "" {
+		return h
+	}
+	return ""
+}
+
+// rebuildFilters rebuilds the Bloom filters from the current revocation set,
+// taking the write lock itself.
+func (c *Cache) rebuildFilters() {
+	c.mu.Lock()
+	c.rebuildFiltersLocked()
+	c.mu.Unlock()
+}
+
+// rebuildFiltersLocked rebuilds the Bloom filters in place. Callers must
+// already hold c.mu for writing. The new filters are built completely before
+// being assigned, so a concurrent reader taking the read lock in
+// MightBeRevoked never observes a half-populated filter.
+func (c *Cache) rebuildFiltersLocked() {
+	tokenCount, claimCount := 0, 0
+	for _, r := range c.revocations {
+		switch r.Type {
+		case REVOCATION_TYPE_TOKEN:
+			tokenCount++
+		case REVOCATION_TYPE_CLAIM:
+			claimCount++
+		}
+	}
+	tokenFilter := newBloomFilter(tokenCount, c.fpRate)
+	claimFilter := newBloomFilter(claimCount, c.fpRate)
+	for key, r := range c.revocations {
+		switch r.Type {
+		case REVOCATION_TYPE_TOKEN:
+			tokenFilter.add(key)
+		case REVOCATION_TYPE_CLAIM:
+			claimFilter.add(key)
+		}
+	}
+	c.tokenFilter = tokenFilter
+	c.claimFilter = claimFilter
+}
+
+// MightBeRevoked reports whether hash could belong to a revoked token or
+// claim value. A false result is definitive and lets the caller skip the
+// exact scan entirely; a true result still needs confirming, since Bloom
+// filters have false positives.
+func (c *Cache) MightBeRevoked(hash string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tokenFilter.mightContain(hash) || c.claimFilter.mightContain(hash)
+}
+
+// contains does the exact check MightBeRevoked lets callers skip for the
+// common negative case.
+func (c *Cache) contains(hash string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, found := c.revocations[hash]
+	return found
+}
+
+// CheckRevoked is the entry point token validation should use: it consults
+// the Bloom filter first and only falls through to the exact check when the
+// filter says "maybe revoked", recording false positives along the way.
+func (c *Cache) CheckRevoked(hash string) bool {
+	if !c.MightBeRevoked(hash) {
+		return false
+	}
+	if revoked := c.contains(hash); revoked {
+		return true
+	}
+	incCounter("planb.tokeninfo.revoke.bloom.false_positives")
+	return false
+}
+
+func incCounter(key string) {
+	if c, ok := metrics.DefaultRegistry.GetOrRegister(key, metrics.NewCounter).(metrics.Counter); ok {
+		c.Inc(1)
+	}
+}
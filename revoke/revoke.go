@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -81,6 +82,48 @@ func (j *jsonRevocation) validGlobal() bool {
 	return false
 }
 
+// Test whether the jsonRevocation holds a valid force-refresh revocation.
+func (j *jsonRevocation) validForceRefresh() bool {
+	if j.Type == REVOCATION_TYPE_FORCEREFRESH &&
+		j.RevokedAt != 0 &&
+		j.Data.IssuedBefore != 0 {
+		return true
+	}
+	return false
+}
+
+// forceRefreshThreshold is the most recent IssuedBefore timestamp seen
+// across all FORCEREFRESH revocations processed so far. Caches that store
+// anything derived from a token or claim (the tokeninfoproxy ccache.Cache,
+// JWT signature/claim caches, ...) consult it via ForceRefreshedBefore to
+// decide whether an entry must be treated as evicted even though it hasn't
+// expired yet.
+var forceRefreshThreshold int64
+
+// UpdateForceRefreshThreshold advances the package-wide force-refresh
+// watermark if issuedBefore is newer than the current value. Safe for
+// concurrent use; callers race harmlessly and the highest value wins.
+// Call this when a parsed revocation batch is actually committed (see
+// Cache.Set), not while merely parsing/validating one - toRevocation itself
+// has no side effects.
+func UpdateForceRefreshThreshold(issuedBefore int64) {
+	for {
+		cur := atomic.LoadInt64(&forceRefreshThreshold)
+		if issuedBefore <= cur {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&forceRefreshThreshold, cur, issuedBefore) {
+			return
+		}
+	}
+}
+
+// ForceRefreshedBefore reports whether something issued at issuedAt must be
+// considered stale because of a FORCEREFRESH revocation seen since.
+func ForceRefreshedBefore(issuedAt int64) bool {
+	return issuedAt < atomic.LoadInt64(&forceRefreshThreshold)
+}
+
 // Returns a Revocation if json data is valid; otherwise, return an error.
 func (j *jsonRevocation) toRevocation() (*Revocation, error) {
 
@@ -112,6 +155,13 @@ func (j *jsonRevocation) toRevocation() (*Revocation, error) {
 			log.Printf("Invalid revocation data (GLOBAL). IssuedBefore: %d, RevokedAt: %d", j.Data.IssuedBefore, j.RevokedAt)
 			return nil, ErrInvalidRevocation
 		}
+
+	case REVOCATION_TYPE_FORCEREFRESH:
+		if !j.validForceRefresh() {
+			log.Printf("Invalid revocation data (FORCEREFRESH). IssuedBefore: %d, RevokedAt: %d", j.Data.IssuedBefore, j.RevokedAt)
+			return nil, ErrInvalidRevocation
+		}
+
 	default:
 		log.Printf("Unsupported revocation type: %s", j.Type)
 		return nil, ErrUnsupportedType